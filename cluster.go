@@ -0,0 +1,410 @@
+package disposable_redis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// TotalSlots is the number of hash slots a redis cluster is divided into.
+const TotalSlots = 16384
+
+// how long we sleep after the CLUSTER MEETs (and after a CLUSTER FAILOVER) to
+// let gossip propagate; the cluster's state is not polled to confirm it settled
+const clusterGossipWait = 200 * time.Millisecond
+
+// clusterNode is a single disposable redis-server participating in a Cluster.
+type clusterNode struct {
+	server Server
+	id     string
+}
+
+// clusterShard is one master and its replicas.
+type clusterShard struct {
+	master   *clusterNode
+	replicas []*clusterNode
+}
+
+// Cluster is a disposable redis cluster: a set of disposable redis-servers
+// wired together with CLUSTER MEET/ADDSLOTS/REPLICATE into a single working
+// cluster, without shelling out to redis-cli --cluster create.
+type Cluster struct {
+	shards    []*clusterShard
+	slotOwner map[uint16]*clusterNode
+}
+
+// NewCluster launches `shards` disposable redis-servers in cluster mode, each
+// with replicasPerShard replicas, assigns the 16384 hash slots evenly across
+// the masters, and wires replicas up with CLUSTER REPLICATE.
+func NewCluster(shards int, replicasPerShard int) (*Cluster, error) {
+
+	if shards < 1 {
+		return nil, fmt.Errorf("disposable_redis: shards must be at least 1, got %d", shards)
+	}
+	if replicasPerShard < 0 {
+		return nil, fmt.Errorf("disposable_redis: replicasPerShard must not be negative, got %d", replicasPerShard)
+	}
+
+	c := &Cluster{}
+
+	ok := false
+	defer func() {
+		if !ok {
+			c.Stop()
+		}
+	}()
+
+	for i := 0; i < shards; i++ {
+		master, err := newClusterNode()
+		if err != nil {
+			return nil, err
+		}
+
+		shard := &clusterShard{master: master}
+		for j := 0; j < replicasPerShard; j++ {
+			replica, err := newClusterNode()
+			if err != nil {
+				return nil, err
+			}
+			shard.replicas = append(shard.replicas, replica)
+		}
+		c.shards = append(c.shards, shard)
+	}
+
+	seed := c.shards[0].master
+	for _, node := range c.clusterNodes() {
+		if node == seed {
+			continue
+		}
+		if err := clusterMeet(node, seed); err != nil {
+			return nil, err
+		}
+	}
+
+	// give the cluster bus a moment to gossip the CLUSTER MEETs around
+	time.Sleep(clusterGossipWait)
+
+	slot := uint16(0)
+	perShard := TotalSlots / len(c.shards)
+	for i, shard := range c.shards {
+		n := perShard
+		if i == len(c.shards)-1 {
+			n = TotalSlots - int(slot) // last shard gets the remainder
+		}
+		slots := make([]uint16, n)
+		for j := range slots {
+			slots[j] = slot
+			slot++
+		}
+		if err := addSlots(shard.master, slots); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, shard := range c.shards {
+		for _, replica := range shard.replicas {
+			if err := clusterReplicate(replica, shard.master); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := c.RefreshSlots(); err != nil {
+		return nil, err
+	}
+
+	ok = true
+	return c, nil
+}
+
+// newClusterNode starts a disposable redis-server with cluster mode enabled,
+// built through NewServerWithOptions like every other backend in this
+// package, so it gets a freeport()-chosen port, a managed per-instance
+// tempdir, process-group kill, and finalizer cleanup for free instead of
+// hand-rolling a second, stale code path.
+func newClusterNode() (*clusterNode, error) {
+	srv, err := NewServerWithOptions(Options{
+		Backend: BackendProcess,
+		ExtraConfig: map[string]string{
+			"cluster-enabled":     "yes",
+			"cluster-config-file": "nodes.conf",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := srv.WaitReady(LaunchWaitTimeout); err != nil {
+		srv.Stop()
+		return nil, err
+	}
+
+	id, err := clusterMyID(srv)
+	if err != nil {
+		srv.Stop()
+		return nil, err
+	}
+
+	return &clusterNode{server: srv, id: id}, nil
+}
+
+func clusterMyID(s Server) (string, error) {
+	conn, err := redigo.Dial("tcp", s.Addr())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	return redigo.String(conn.Do("CLUSTER", "MYID"))
+}
+
+func clusterMeet(node *clusterNode, other *clusterNode) error {
+	conn, err := redigo.Dial("tcp", node.server.Addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	host, port, err := net.SplitHostPort(other.server.Addr())
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("CLUSTER", "MEET", host, port)
+	return err
+}
+
+func clusterReplicate(replica *clusterNode, master *clusterNode) error {
+	conn, err := redigo.Dial("tcp", replica.server.Addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("CLUSTER", "REPLICATE", master.id)
+	return err
+}
+
+func addSlots(node *clusterNode, slots []uint16) error {
+	conn, err := redigo.Dial("tcp", node.server.Addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := make([]interface{}, len(slots)+1)
+	args[0] = "ADDSLOTS"
+	for i, s := range slots {
+		args[i+1] = s
+	}
+
+	_, err = conn.Do("CLUSTER", args...)
+	return err
+}
+
+// Nodes returns every server (masters and replicas) participating in the cluster.
+func (c *Cluster) Nodes() []Server {
+	var nodes []Server
+	for _, node := range c.clusterNodes() {
+		nodes = append(nodes, node.server)
+	}
+	return nodes
+}
+
+// clusterNodes returns every clusterNode (masters and replicas) participating
+// in the cluster, for internal use where the *clusterNode (not just its
+// Server) is needed, e.g. to look up its cluster ID.
+func (c *Cluster) clusterNodes() []*clusterNode {
+	var nodes []*clusterNode
+	for _, shard := range c.shards {
+		nodes = append(nodes, shard.master)
+		nodes = append(nodes, shard.replicas...)
+	}
+	return nodes
+}
+
+// RefreshSlots recomputes the slot-owner map by parsing CLUSTER SLOTS.
+func (c *Cluster) RefreshSlots() error {
+	conn, err := redigo.Dial("tcp", c.shards[0].master.server.Addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reply, err := redigo.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string]*clusterNode)
+	for _, shard := range c.shards {
+		byID[shard.master.id] = shard.master
+		for _, r := range shard.replicas {
+			byID[r.id] = r
+		}
+	}
+
+	owner := make(map[uint16]*clusterNode)
+	for _, row := range reply {
+		entry, err := redigo.Values(row, nil)
+		if err != nil {
+			return err
+		}
+		if len(entry) < 3 {
+			continue
+		}
+		start, _ := redigo.Int(entry[0], nil)
+		end, _ := redigo.Int(entry[1], nil)
+
+		masterInfo, err := redigo.Values(entry[2], nil)
+		if err != nil || len(masterInfo) < 3 {
+			continue
+		}
+		id, _ := redigo.String(masterInfo[2], nil)
+		node := byID[id]
+
+		for slot := start; slot <= end; slot++ {
+			owner[uint16(slot)] = node
+		}
+	}
+
+	c.slotOwner = owner
+	return nil
+}
+
+// SlotOwner returns the server that currently owns the given hash slot.
+func (c *Cluster) SlotOwner(slot uint16) (Server, error) {
+	node, ok := c.slotOwner[slot]
+	if !ok || node == nil {
+		return nil, fmt.Errorf("disposable_redis: slot %d has no known owner", slot)
+	}
+	return node.server, nil
+}
+
+// Reshard moves slots from one node to another, following the
+// MIGRATE/SETSLOT IMPORTING/MIGRATING/NODE dance, and updates the slot-owner map.
+func (c *Cluster) Reshard(from Server, to Server, slots []uint16) error {
+	fromNode := c.nodeFor(from)
+	toNode := c.nodeFor(to)
+	if fromNode == nil || toNode == nil {
+		return fmt.Errorf("disposable_redis: from/to are not members of this cluster")
+	}
+
+	fromConn, err := redigo.Dial("tcp", from.Addr())
+	if err != nil {
+		return err
+	}
+	defer fromConn.Close()
+
+	toConn, err := redigo.Dial("tcp", to.Addr())
+	if err != nil {
+		return err
+	}
+	defer toConn.Close()
+
+	toHost, toPort, err := net.SplitHostPort(to.Addr())
+	if err != nil {
+		return err
+	}
+	toPortNum, err := strconv.Atoi(toPort)
+	if err != nil {
+		return err
+	}
+
+	for _, slot := range slots {
+		if _, err := toConn.Do("CLUSTER", "SETSLOT", slot, "IMPORTING", fromNode.id); err != nil {
+			return err
+		}
+		if _, err := fromConn.Do("CLUSTER", "SETSLOT", slot, "MIGRATING", toNode.id); err != nil {
+			return err
+		}
+
+		for {
+			keys, err := redigo.Strings(fromConn.Do("CLUSTER", "GETKEYSINSLOT", slot, 100))
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				break
+			}
+			for _, key := range keys {
+				if _, err := fromConn.Do("MIGRATE", toHost, toPortNum, key, 0, 5000); err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err := fromConn.Do("CLUSTER", "SETSLOT", slot, "NODE", toNode.id); err != nil {
+			return err
+		}
+		if _, err := toConn.Do("CLUSTER", "SETSLOT", slot, "NODE", toNode.id); err != nil {
+			return err
+		}
+
+		if c.slotOwner == nil {
+			c.slotOwner = make(map[uint16]*clusterNode)
+		}
+		c.slotOwner[slot] = toNode
+	}
+
+	return nil
+}
+
+func (c *Cluster) nodeFor(s Server) *clusterNode {
+	for _, shard := range c.shards {
+		if shard.master.server == s {
+			return shard.master
+		}
+		for _, r := range shard.replicas {
+			if r.server == s {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// Failover promotes a replica of the given shard to master, via CLUSTER FAILOVER.
+func (c *Cluster) Failover(shard int) error {
+	if shard < 0 || shard >= len(c.shards) {
+		return fmt.Errorf("disposable_redis: no such shard %d", shard)
+	}
+	s := c.shards[shard]
+	if len(s.replicas) == 0 {
+		return fmt.Errorf("disposable_redis: shard %d has no replicas to fail over to", shard)
+	}
+
+	replica := s.replicas[0]
+	conn, err := redigo.Dial("tcp", replica.server.Addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("CLUSTER", "FAILOVER"); err != nil {
+		return err
+	}
+
+	time.Sleep(clusterGossipWait)
+
+	s.replicas[0] = s.master
+	s.master = replica
+
+	return c.RefreshSlots()
+}
+
+// Stop shuts down every server in the cluster.
+func (c *Cluster) Stop() error {
+	for _, shard := range c.shards {
+		for _, r := range shard.replicas {
+			r.server.Stop()
+		}
+		if shard.master != nil {
+			shard.master.server.Stop()
+		}
+	}
+	return nil
+}
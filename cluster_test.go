@@ -0,0 +1,183 @@
+package disposable_redis
+
+import (
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// TestCluster spins up a small real cluster (2 shards, 1 replica each),
+// and makes sure the slots it was assigned actually work end to end.
+func TestCluster(t *testing.T) {
+	if !redisServerAvailable() {
+		t.Skip("redis-server not found on $PATH")
+	}
+
+	c, err := NewCluster(2, 1)
+	if err != nil {
+		t.Fatalf("could not create cluster: %v", err)
+	}
+	defer c.Stop()
+
+	if nodes := c.Nodes(); len(nodes) != 4 {
+		t.Fatalf("expected 4 nodes (2 shards * (1 master + 1 replica)), got %d", len(nodes))
+	}
+
+	// ask any node which slot "foo" belongs to, then go talk to whichever
+	// node this cluster assigned that slot to.
+	any, err := c.SlotOwner(0)
+	if err != nil {
+		t.Fatalf("could not find owner of slot 0: %v", err)
+	}
+	anyConn, err := redigo.Dial("tcp", any.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to cluster node: %v", err)
+	}
+	defer anyConn.Close()
+
+	slot, err := redigo.Int(anyConn.Do("CLUSTER", "KEYSLOT", "foo"))
+	if err != nil {
+		t.Fatalf("could not compute key slot: %v", err)
+	}
+
+	owner, err := c.SlotOwner(uint16(slot))
+	if err != nil {
+		t.Fatalf("could not find owner of slot %d: %v", slot, err)
+	}
+
+	conn, err := redigo.Dial("tcp", owner.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to slot owner: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", "foo", "bar"); err != nil {
+		t.Fatalf("could not SET on slot owner: %v", err)
+	}
+
+	val, err := redigo.String(conn.Do("GET", "foo"))
+	if err != nil || val != "bar" {
+		t.Fatalf("unexpected GET result: %q, %v", val, err)
+	}
+}
+
+// TestClusterFailover writes a key to a shard's master, fails that shard
+// over, and makes sure the promoted replica serves the key it inherited.
+func TestClusterFailover(t *testing.T) {
+	if !redisServerAvailable() {
+		t.Skip("redis-server not found on $PATH")
+	}
+
+	c, err := NewCluster(1, 1)
+	if err != nil {
+		t.Fatalf("could not create cluster: %v", err)
+	}
+	defer c.Stop()
+
+	oldMaster := c.shards[0].master.server
+	oldReplica := c.shards[0].replicas[0].server
+
+	conn, err := redigo.Dial("tcp", oldMaster.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to master: %v", err)
+	}
+	if _, err := conn.Do("SET", "foo", "bar"); err != nil {
+		t.Fatalf("could not SET on master: %v", err)
+	}
+	conn.Close()
+
+	if err := c.Failover(0); err != nil {
+		t.Fatalf("failover failed: %v", err)
+	}
+
+	if c.shards[0].master.server != oldReplica {
+		t.Fatalf("expected the former replica to be promoted to master")
+	}
+	if c.shards[0].replicas[0].server != oldMaster {
+		t.Fatalf("expected the former master to become a replica")
+	}
+
+	newConn, err := redigo.Dial("tcp", oldReplica.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to promoted master: %v", err)
+	}
+	defer newConn.Close()
+
+	val, err := redigo.String(newConn.Do("GET", "foo"))
+	if err != nil || val != "bar" {
+		t.Fatalf("promoted master doesn't have the pre-failover data: %q, %v", val, err)
+	}
+}
+
+// TestClusterReshard moves a slot from one master to another and makes sure
+// the key that lived in it is readable from its new owner afterwards.
+func TestClusterReshard(t *testing.T) {
+	if !redisServerAvailable() {
+		t.Skip("redis-server not found on $PATH")
+	}
+
+	c, err := NewCluster(2, 0)
+	if err != nil {
+		t.Fatalf("could not create cluster: %v", err)
+	}
+	defer c.Stop()
+
+	from, err := c.SlotOwner(0)
+	if err != nil {
+		t.Fatalf("could not find owner of slot 0: %v", err)
+	}
+
+	fromConn, err := redigo.Dial("tcp", from.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to slot owner: %v", err)
+	}
+	// the hash tag "06S" hashes to slot 0, so this key lives on `from`
+	if _, err := fromConn.Do("SET", "{06S}key", "bar"); err != nil {
+		t.Fatalf("could not SET on slot owner: %v", err)
+	}
+	fromConn.Close()
+
+	var to Server
+	for _, n := range c.Nodes() {
+		if n != from {
+			to = n
+			break
+		}
+	}
+	if to == nil {
+		t.Fatal("could not find another node to reshard to")
+	}
+
+	conn, err := redigo.Dial("tcp", from.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to slot owner: %v", err)
+	}
+	keySlot, err := redigo.Int(conn.Do("CLUSTER", "KEYSLOT", "{06S}key"))
+	conn.Close()
+	if err != nil {
+		t.Fatalf("could not compute key slot: %v", err)
+	}
+
+	if err := c.Reshard(from, to, []uint16{uint16(keySlot)}); err != nil {
+		t.Fatalf("reshard failed: %v", err)
+	}
+
+	owner, err := c.SlotOwner(uint16(keySlot))
+	if err != nil {
+		t.Fatalf("could not find new owner of slot %d: %v", keySlot, err)
+	}
+	if owner != to {
+		t.Fatalf("expected slot %d to now be owned by the reshard target", keySlot)
+	}
+
+	toConn, err := redigo.Dial("tcp", to.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to new slot owner: %v", err)
+	}
+	defer toConn.Close()
+
+	val, err := redigo.String(toConn.Do("GET", "{06S}key"))
+	if err != nil || val != "bar" {
+		t.Fatalf("migrated key is not readable from its new owner: %q, %v", val, err)
+	}
+}
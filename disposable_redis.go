@@ -7,11 +7,19 @@
 package disposable_redis
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	redigo "github.com/garyburd/redigo/redis"
@@ -28,21 +36,203 @@ const (
 	LaunchWaitTimeout = 100 * time.Millisecond
 )
 
-// A wrapper reperesenting a running disposable redis server
-type Server struct {
-	cmd     *exec.Cmd
-	port    uint16
-	running bool
+// readyLogMarker is the line redis-server logs once it's accepting connections.
+// We scan for it instead of blindly sleeping, so WaitReady/run can return as
+// soon as the server is actually up.
+const readyLogMarker = "Ready to accept connections"
+
+// logStreamBuffer is how many not-yet-consumed lines LogStream will buffer
+// before it starts dropping them, so a slow or absent reader can't make the
+// server's own stdout/stderr pipes back up.
+const logStreamBuffer = 256
+
+// Backend selects which implementation backs a Server.
+type Backend int
+
+const (
+	// BackendAuto uses a real redis-server process if RedisCommand can be found
+	// on $PATH, and transparently falls back to the embedded miniredis backend
+	// otherwise. This is the default used by NewServer/NewServerRandomPort.
+	BackendAuto Backend = iota
+	// BackendProcess always shells out to RedisCommand, and fails if it can't be launched.
+	BackendProcess
+	// BackendMini always uses the embedded pure-Go miniredis implementation,
+	// regardless of whether redis-server is installed.
+	BackendMini
+)
+
+// A Server is a running disposable redis instance, whether backed by a real
+// redis-server process or by the embedded miniredis fallback.
+type Server interface {
+	// Port this server is listening on
+	Port() uint16
+	// Addr returns the address of the server as a host:port string, or the
+	// path to its unix socket if it was created with Options.UnixSocket
+	Addr() string
+	// WaitReady blocks until the server is ready to accept connections, or the timeout elapses
+	WaitReady(timeout time.Duration) error
+	// Stop shuts the server down
+	Stop() error
+	// Info returns the value of the server's INFO command parsed into a map of strings
+	Info() (map[string]string, error)
+	// NewSlaveOf creates a new server and makes it a slave of this one
+	NewSlaveOf() (Server, error)
+	// Logs returns every line the server has written to stdout/stderr so far.
+	Logs() []string
+	// LogStream returns a channel fed with each line the server writes to
+	// stdout/stderr as it's produced, for tests that want to assert on
+	// server-side behavior (e.g. slowlog warnings, module load messages).
+	LogStream() <-chan string
+}
+
+// Options configures how a Server is created. The zero value uses BackendAuto
+// and picks a free port.
+type Options struct {
+	// Backend selects which implementation to use. Defaults to BackendAuto.
+	Backend Backend
+	// Port to listen on. If 0, a free port is chosen via freeport().
+	// BackendMini ignores it and always listens on a kernel-assigned port.
+	Port uint16
+	// UnixSocket, if true, binds the process backend to an ephemeral unix
+	// socket instead of a TCP port, for even more reliable test isolation.
+	// It's ignored by the BackendMini backend, which has no process to bind.
+	UnixSocket bool
+
+	// Password, if set, is written as `requirepass` and used to AUTH on every
+	// dial this package makes to the server (WaitReady, Info, NewSlaveOf).
+	Password string
+	// AOF enables the append-only file (`appendonly yes`).
+	AOF bool
+	// MaxMemory sets `maxmemory`, e.g. "100mb".
+	MaxMemory string
+	// MaxMemoryPolicy sets `maxmemory-policy`, e.g. "allkeys-lru".
+	MaxMemoryPolicy string
+	// Databases sets the number of selectable databases. If 0, redis's default is used.
+	Databases int
+	// LoadModule is a list of paths to shared libraries loaded via `loadmodule`.
+	LoadModule []string
+
+	// TLSPort, if non-zero, additionally enables the TLS listener via `tls-port`.
+	TLSPort uint16
+	// CertFile is the `tls-cert-file` to serve.
+	CertFile string
+	// KeyFile is the `tls-key-file` matching CertFile.
+	KeyFile string
+	// CAFile is the `tls-ca-cert-file` used to verify client certificates.
+	CAFile string
+
+	// ExtraConfig holds arbitrary directive/value pairs appended verbatim to
+	// the generated redis.conf, for anything not covered by a named field.
+	ExtraConfig map[string]string
+}
+
+// processServer is a Server backed by a real redis-server child process.
+type processServer struct {
+	cmd      *exec.Cmd
+	port     uint16
+	network  string // "tcp" or "unix"
+	addr     string // host:port, or the unix socket path
+	password string
+	confPath string
+	tempDir  string  // per-instance scratch dir, removed wholesale on Stop
+	opts     Options // the Options this server was created with, reused by NewSlaveOf
+	running  bool
+
+	readyCh   chan struct{} // closed the first time readyLogMarker is seen
+	readyOnce sync.Once
+
+	logMu    sync.Mutex
+	logLines []string
+	logCh    chan string
+}
+
+// liveServers tracks every processServer that hasn't been Stop()ed yet, so
+// that finalize can still reap them (and the process groups they spawned) if
+// a caller forgets to call Stop, e.g. because a test panicked.
+var (
+	liveServersMu sync.Mutex
+	liveServers   = map[*processServer]struct{}{}
+)
+
+// finalize is run by the garbage collector if a processServer is dropped
+// without Stop ever being called. It's a last-resort safety net, not a
+// substitute for callers calling Stop themselves.
+func (r *processServer) finalize() {
+	if !r.running {
+		return
+	}
+	log.Println("disposable_redis: server was garbage collected without Stop being called, cleaning up:", r.addr)
+	r.Stop()
+}
+
+// dial connects to the server, authenticating first if a password is configured.
+func (r *processServer) dial() (redigo.Conn, error) {
+	return dialAuth(r.network, r.addr, r.password)
+}
+
+// dialAuth dials network/addr and, if password is non-empty, authenticates
+// with AUTH before returning the connection.
+func dialAuth(network, addr, password string) (redigo.Conn, error) {
+	conn, err := redigo.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		if _, err := conn.Do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// watchLog scans lines out of one of the child's output pipes, recording
+// them and forwarding them to LogStream, until the pipe is closed (i.e. the
+// process exits). It also watches for readyLogMarker to signal readiness.
+func (r *processServer) watchLog(pipe io.Reader) {
+	scanner := bufio.NewScanner(pipe)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		r.logMu.Lock()
+		r.logLines = append(r.logLines, line)
+		r.logMu.Unlock()
+
+		select {
+		case r.logCh <- line:
+		default:
+			// nobody's reading fast enough; drop rather than block the server.
+		}
+
+		if strings.Contains(line, readyLogMarker) {
+			r.readyOnce.Do(func() { close(r.readyCh) })
+		}
+	}
 }
 
 // Start and run the process, return an error if it cannot be run
-func (r *Server) run() error {
+func (r *processServer) run() error {
 
-	ret := r.cmd.Start()
+	stdout, err := r.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := r.cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := r.cmd.Start(); err != nil {
+		return err
+	}
+
+	go r.watchLog(stdout)
+	go r.watchLog(stderr)
 
 	ch := make(chan error)
 
-	// we wait for LaunchWaitTimeout and see if the server quit due to an error
+	// we wait for the server to log readyLogMarker, or up to LaunchWaitTimeout
+	// if it never does, and see if the server quit due to an error in the meantime
 	go func() {
 		err := r.cmd.Wait()
 		select {
@@ -55,57 +245,226 @@ func (r *Server) run() error {
 	case e := <-ch:
 		log.Println("Error waiting for process:", e)
 		return e
+	case <-r.readyCh:
+		return nil
 	case <-time.After(LaunchWaitTimeout):
-		break
-
+		return nil
 	}
-
-	return ret
 }
 
 // Create and run a new server on a given port.
 // Return an error if the server cannot be started
-func NewServer(port uint16) (*Server, error) {
+func NewServer(port uint16) (Server, error) {
+	return NewServerWithOptions(Options{Backend: BackendAuto, Port: port})
+}
 
-	cmd := exec.Command(RedisCommand,
-		"--port", fmt.Sprintf("%d", port),
-		"--pidfile", fmt.Sprintf("/tmp/disposable_redis.%d.pid", port),
-		"--dir", "/tmp",
-		"--dbfilename", fmt.Sprintf("dump.%d.%d.rdb", port, time.Now().UnixNano()),
-	)
+// NewServerWithOptions creates a new server according to opts, choosing the
+// backend implementation as requested (or automatically, for BackendAuto).
+func NewServerWithOptions(opts Options) (Server, error) {
 
-	log.Println("start args: ", cmd.Args)
+	backend := opts.Backend
+	if backend == BackendAuto {
+		if _, err := exec.LookPath(RedisCommand); err != nil {
+			log.Println(RedisCommand, "not found on $PATH, falling back to miniredis:", err)
+			backend = BackendMini
+		} else {
+			backend = BackendProcess
+		}
+	}
+
+	if backend == BackendMini {
+		if unsupported := unsupportedMiniOptions(opts); len(unsupported) > 0 {
+			return nil, fmt.Errorf("disposable_redis: BackendMini cannot honor option(s) %v; install %s or drop them", unsupported, RedisCommand)
+		}
+		return newMiniServer(opts)
+	}
+
+	port := opts.Port
+	if port == 0 {
+		var err error
+		port, err = freeport()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tempDir, err := ioutil.TempDir("", "disposable-redis-")
+	if err != nil {
+		return nil, err
+	}
 
-	r := &Server{
-		cmd:     cmd,
-		port:    port,
-		running: false,
+	r := &processServer{
+		port:     port,
+		network:  "tcp",
+		addr:     fmt.Sprintf("localhost:%d", port),
+		password: opts.Password,
+		tempDir:  tempDir,
+		opts:     opts,
+		readyCh:  make(chan struct{}),
+		logCh:    make(chan string, logStreamBuffer),
 	}
 
-	err := r.run()
+	var sockPath string
+	if opts.UnixSocket {
+		sockPath = filepath.Join(tempDir, "redis.sock")
+
+		r.port = 0
+		r.network = "unix"
+		r.addr = sockPath
+	}
+
+	confPath, err := writeConfigFile(opts, port, tempDir, sockPath)
 	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+	r.confPath = confPath
+
+	cmd := exec.Command(RedisCommand, confPath)
+	log.Println("start args: ", cmd.Args)
+	// Put the child in its own process group, so Stop can kill it along with
+	// any workers it forks (e.g. BGSAVE) in one shot.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	r.cmd = cmd
+
+	if err := r.run(); err != nil {
+		os.RemoveAll(tempDir)
 		return nil, err
 	}
 	r.running = true
 
+	liveServersMu.Lock()
+	liveServers[r] = struct{}{}
+	liveServersMu.Unlock()
+	runtime.SetFinalizer(r, (*processServer).finalize)
+
 	return r, nil
 
 }
 
-// Create a new server on a random port. If the port is taken we retry (10 times).
+// unsupportedMiniOptions returns the name of every Options field set by the
+// caller that the BackendMini backend has no way to honor, so callers get a
+// loud error instead of a server that silently ignores half of what they
+// asked for. UnixSocket is deliberately not included here: it's documented
+// on Options as being ignored by BackendMini, which already listens on a
+// real TCP port regardless.
+func unsupportedMiniOptions(opts Options) []string {
+	var unsupported []string
+	if opts.AOF {
+		unsupported = append(unsupported, "AOF")
+	}
+	if opts.MaxMemory != "" {
+		unsupported = append(unsupported, "MaxMemory")
+	}
+	if opts.MaxMemoryPolicy != "" {
+		unsupported = append(unsupported, "MaxMemoryPolicy")
+	}
+	if opts.Databases != 0 {
+		unsupported = append(unsupported, "Databases")
+	}
+	if len(opts.LoadModule) > 0 {
+		unsupported = append(unsupported, "LoadModule")
+	}
+	if opts.TLSPort != 0 {
+		unsupported = append(unsupported, "TLSPort")
+	}
+	if len(opts.ExtraConfig) > 0 {
+		unsupported = append(unsupported, "ExtraConfig")
+	}
+	return unsupported
+}
+
+// writeConfigFile renders opts into a redis.conf file inside tempDir and
+// returns its path. Config directives are written to a file (rather than
+// passed as `--flag` args) because several of them — TLS settings,
+// requirepass with special characters, multi-word directives — don't
+// round-trip cleanly through shell-style flags.
+func writeConfigFile(opts Options, port uint16, tempDir, sockPath string) (string, error) {
+
+	f, err := os.Create(filepath.Join(tempDir, "redis.conf"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fmt.Fprintln(f, "pidfile", filepath.Join(tempDir, "redis.pid"))
+	fmt.Fprintln(f, "dir", tempDir)
+	fmt.Fprintln(f, "dbfilename", fmt.Sprintf("dump.%d.%d.rdb", port, time.Now().UnixNano()))
+
+	if sockPath != "" {
+		fmt.Fprintln(f, "port 0")
+		fmt.Fprintln(f, "unixsocket", sockPath)
+		fmt.Fprintln(f, "unixsocketperm 700")
+	} else {
+		fmt.Fprintln(f, "port", port)
+	}
+
+	if opts.Password != "" {
+		fmt.Fprintln(f, "requirepass", opts.Password)
+		// also set as masterauth, in case this server ends up replicating
+		// from another disposable server created with the same password
+		fmt.Fprintln(f, "masterauth", opts.Password)
+	}
+	if opts.AOF {
+		fmt.Fprintln(f, "appendonly yes")
+	}
+	if opts.MaxMemory != "" {
+		fmt.Fprintln(f, "maxmemory", opts.MaxMemory)
+	}
+	if opts.MaxMemoryPolicy != "" {
+		fmt.Fprintln(f, "maxmemory-policy", opts.MaxMemoryPolicy)
+	}
+	if opts.Databases > 0 {
+		fmt.Fprintln(f, "databases", opts.Databases)
+	}
+	for _, module := range opts.LoadModule {
+		fmt.Fprintln(f, "loadmodule", module)
+	}
+
+	if opts.TLSPort > 0 {
+		fmt.Fprintln(f, "tls-port", opts.TLSPort)
+		if opts.CertFile != "" {
+			fmt.Fprintln(f, "tls-cert-file", opts.CertFile)
+		}
+		if opts.KeyFile != "" {
+			fmt.Fprintln(f, "tls-key-file", opts.KeyFile)
+		}
+		if opts.CAFile != "" {
+			fmt.Fprintln(f, "tls-ca-cert-file", opts.CAFile)
+		}
+	}
+
+	for directive, value := range opts.ExtraConfig {
+		fmt.Fprintln(f, directive, value)
+	}
+
+	return f.Name(), nil
+}
+
+// NewServerFreePort creates a new server on a port obtained from freeport(),
+// which is far less likely to collide with another listener than picking a
+// random port and hoping for the best.
+func NewServerFreePort() (Server, error) {
+	port, err := freeport()
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(port)
+}
+
+// Create a new server on a free port obtained via freeport(). If starting it
+// races with something else grabbing the port, we retry (10 times).
 // If we still couldn't start the process, we return an error
-func NewServerRandomPort() (*Server, error) {
+func NewServerRandomPort() (Server, error) {
 
 	var err error
-	var r *Server
+	var r Server
 	for i := 0; i < MaxRetries; i++ {
-		port := uint16(rand.Int31n(0xffff-1025) + 1025)
-		log.Println("Trying port ", port)
-
-		r, err = NewServer(port)
+		r, err = NewServerFreePort()
 		if err == nil {
 			return r, nil
 		}
+		log.Println("Could not start on free port, retrying:", err)
 	}
 
 	log.Println("Could not start throwaway redis")
@@ -115,14 +474,26 @@ func NewServerRandomPort() (*Server, error) {
 
 // Wait for the server to be ready, or until a timeout has elapsed.
 // This just blocks and waits using sleep intervals of 5ms if it can't connect
-func (r *Server) WaitReady(timeout time.Duration) error {
+func (r *processServer) WaitReady(timeout time.Duration) error {
+
+	select {
+	case <-r.readyCh:
+		return nil
+	default:
+	}
 
 	deadline := time.Now().Add(timeout)
 	var err error
 
 	for time.Now().Before(deadline) {
 
-		conn, e := redigo.Dial("tcp", fmt.Sprintf("localhost:%d", r.port))
+		select {
+		case <-r.readyCh:
+			return nil
+		default:
+		}
+
+		conn, e := r.dial()
 		if e != nil {
 			log.Println("Could not connect, waiting 5ms")
 			err = e
@@ -137,25 +508,32 @@ func (r *Server) WaitReady(timeout time.Duration) error {
 
 }
 
-// Stop the running redis server
-func (r *Server) Stop() error {
+// Stop the running redis server, killing its whole process group (so that
+// any workers it forked, e.g. BGSAVE, are reaped too) and removing its
+// per-instance temp directory.
+func (r *processServer) Stop() error {
 	if !r.running {
 		return nil
 	}
 	r.running = false
-	if err := r.cmd.Process.Kill(); err != nil {
+
+	liveServersMu.Lock()
+	delete(liveServers, r)
+	liveServersMu.Unlock()
+
+	if err := syscall.Kill(-r.cmd.Process.Pid, syscall.SIGKILL); err != nil {
 		return err
 	}
 
 	r.cmd.Wait()
 
-	return nil
+	return os.RemoveAll(r.tempDir)
 
 }
 
 // Info returns the value of the server's INFO command parsed into a map of strings
-func (r Server) Info() (map[string]string, error) {
-	conn, e := redigo.Dial("tcp", r.Addr())
+func (r *processServer) Info() (map[string]string, error) {
+	conn, e := r.dial()
 	if e != nil {
 		return nil, e
 	}
@@ -166,6 +544,11 @@ func (r Server) Info() (map[string]string, error) {
 		return nil, err
 	}
 
+	return parseInfo(info), nil
+}
+
+// parseInfo parses the raw reply of an INFO command into a map of strings.
+func parseInfo(info string) map[string]string {
 	ret := make(map[string]string)
 	lines := strings.Split(info, "\r\n")
 	for _, line := range lines {
@@ -179,13 +562,21 @@ func (r Server) Info() (map[string]string, error) {
 		}
 	}
 
-	return ret, nil
+	return ret
 }
 
-// NewSlaveOf creates a new server with a random port and makes it a slave of the current server.
-func (r Server) NewSlaveOf() (*Server, error) {
+// NewSlaveOf creates a new server, configured like the current one (password,
+// AOF, etc.), on a free port, and makes it a slave of the current server.
+func (r *processServer) NewSlaveOf() (Server, error) {
 
-	srv, err := NewServerRandomPort()
+	if r.network != "tcp" {
+		return nil, fmt.Errorf("disposable_redis: NewSlaveOf requires a TCP master, but this server was created with Options.UnixSocket (SLAVEOF can't target a unix socket)")
+	}
+
+	slaveOpts := r.opts
+	slaveOpts.Port = 0
+
+	srv, err := NewServerWithOptions(slaveOpts)
 	if err != nil {
 		return nil, err
 	}
@@ -195,7 +586,7 @@ func (r Server) NewSlaveOf() (*Server, error) {
 		return nil, err
 	}
 
-	conn, e := redigo.Dial("tcp", srv.Addr())
+	conn, e := dialAuth(r.network, srv.Addr(), r.password)
 	if e != nil {
 		defer srv.Stop()
 		return nil, e
@@ -229,13 +620,31 @@ func (r Server) NewSlaveOf() (*Server, error) {
 }
 
 // Get the port of this server
-func (r Server) Port() uint16 {
+func (r *processServer) Port() uint16 {
 	return r.port
 }
 
-// Addr returns the address of the server as a host:port string
-func (r Server) Addr() string {
-	return fmt.Sprintf("localhost:%d", r.port)
+// Addr returns the address of the server: a host:port string, or the path to
+// its unix socket if it was created with Options.UnixSocket.
+func (r *processServer) Addr() string {
+	return r.addr
+}
+
+// Logs returns every line the server has written to stdout/stderr so far.
+func (r *processServer) Logs() []string {
+	r.logMu.Lock()
+	defer r.logMu.Unlock()
+
+	lines := make([]string, len(r.logLines))
+	copy(lines, r.logLines)
+	return lines
+}
+
+// LogStream returns a channel fed with each line the server writes to
+// stdout/stderr as it's produced. It's shared across calls, so only one
+// consumer should read it at a time.
+func (r *processServer) LogStream() <-chan string {
+	return r.logCh
 }
 
 func init() {
@@ -2,14 +2,35 @@ package disposable_redis
 
 import (
 	"fmt"
+	"os/exec"
 	"testing"
 	"time"
 
 	redigo "github.com/garyburd/redigo/redis"
 )
 
+// redisServerAvailable reports whether RedisCommand can be found on $PATH.
+// Tests that rely on BackendProcess-specific behavior (e.g. that binding an
+// already-used port fails, or that replication works) are skipped when it's
+// not, since BackendAuto would silently fall back to the miniredis backend,
+// which doesn't reproduce that behavior.
+func redisServerAvailable() bool {
+	_, err := exec.LookPath(RedisCommand)
+	return err == nil
+}
+
+// sentinelAvailable reports whether SentinelCommand can be found on $PATH.
+func sentinelAvailable() bool {
+	_, err := exec.LookPath(SentinelCommand)
+	return err == nil
+}
+
 // make sure we can't start 2 servers on the same port
 func TestFailure(t *testing.T) {
+	if !redisServerAvailable() {
+		t.Skip("redis-server not found on $PATH; this assumes the real process backend's port-binding behavior")
+	}
+
 	r, err := NewServerRandomPort()
 	if err != nil {
 		t.Fatal("Could not bind 1:", err)
@@ -63,6 +84,9 @@ func TestDisposableRedis(t *testing.T) {
 }
 
 func TestServerNewSlaveOf(t *testing.T) {
+	if !redisServerAvailable() {
+		t.Skip("redis-server not found on $PATH; the miniredis backend doesn't support replication")
+	}
 
 	master, err := NewServerRandomPort()
 	if err != nil {
@@ -110,6 +134,155 @@ func TestServerNewSlaveOf(t *testing.T) {
 
 }
 
+// TestBackendMini exercises the embedded miniredis backend directly (rather
+// than via BackendAuto's fallback), and makes sure the bits it doesn't
+// support (NewSlaveOf, Logs/LogStream) fail or report empty rather than panic.
+func TestBackendMini(t *testing.T) {
+	r, err := NewServerWithOptions(Options{Backend: BackendMini})
+	if err != nil {
+		t.Fatalf("could not create mini server: %v", err)
+	}
+	defer r.Stop()
+
+	if err := r.WaitReady(50 * time.Millisecond); err != nil {
+		t.Fatalf("mini server was not immediately ready: %v", err)
+	}
+
+	conn, err := redigo.Dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to mini server: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", "foo", "bar"); err != nil {
+		t.Fatalf("could not talk to mini server: %v", err)
+	}
+
+	if _, err := r.NewSlaveOf(); err == nil {
+		t.Fatal("expected NewSlaveOf to fail on the miniredis backend")
+	}
+
+	if logs := r.Logs(); logs != nil {
+		t.Fatalf("expected no logs from the miniredis backend, got %v", logs)
+	}
+
+	if line, ok := <-r.LogStream(); ok {
+		t.Fatalf("expected an already-closed LogStream, got %q", line)
+	}
+}
+
+// TestBackendMiniPassword makes sure the miniredis backend honors Password,
+// and that Options it genuinely can't honor are rejected up front rather
+// than silently ignored.
+func TestBackendMiniPassword(t *testing.T) {
+	r, err := NewServerWithOptions(Options{Backend: BackendMini, Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("could not create password-protected mini server: %v", err)
+	}
+	defer r.Stop()
+
+	conn, err := redigo.Dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to mini server: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err == nil {
+		t.Fatal("expected PING without AUTH to fail on a password-protected mini server")
+	}
+
+	if _, err := conn.Do("AUTH", "hunter2"); err != nil {
+		t.Fatalf("could not AUTH with the configured password: %v", err)
+	}
+	if _, err := conn.Do("PING"); err != nil {
+		t.Fatalf("could not talk to redis after AUTH: %v", err)
+	}
+}
+
+// TestBackendMiniRejectsUnsupportedOptions makes sure options the mini
+// backend can't honor (e.g. AOF) produce an explicit error instead of a
+// server that silently ignores them.
+func TestBackendMiniRejectsUnsupportedOptions(t *testing.T) {
+	if _, err := NewServerWithOptions(Options{Backend: BackendMini, AOF: true}); err == nil {
+		t.Fatal("expected an error requesting AOF on the miniredis backend")
+	}
+}
+
+// TestOptionsUnixSocket makes sure the UnixSocket option binds to a unix
+// socket instead of a TCP port.
+func TestOptionsUnixSocket(t *testing.T) {
+	if !redisServerAvailable() {
+		t.Skip("redis-server not found on $PATH")
+	}
+
+	r, err := NewServerWithOptions(Options{Backend: BackendProcess, UnixSocket: true})
+	if err != nil {
+		t.Fatalf("could not create unix socket server: %v", err)
+	}
+	defer r.Stop()
+
+	if err := r.WaitReady(50 * time.Millisecond); err != nil {
+		t.Fatalf("could not connect to server in time: %v", err)
+	}
+
+	if r.Port() != 0 {
+		t.Fatalf("expected port 0 for a unix socket server, got %d", r.Port())
+	}
+
+	conn, err := redigo.Dial("unix", r.Addr())
+	if err != nil {
+		t.Fatalf("could not dial unix socket %q: %v", r.Addr(), err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		t.Fatalf("could not talk to redis over unix socket: %v", err)
+	}
+
+	if _, err := r.NewSlaveOf(); err == nil {
+		t.Fatal("expected NewSlaveOf to fail for a unix-socket-only master")
+	}
+}
+
+// TestOptionsPassword makes sure a Password option both locks the server
+// down and lets this package's own dial helpers (WaitReady, Info) through.
+func TestOptionsPassword(t *testing.T) {
+	if !redisServerAvailable() {
+		t.Skip("redis-server not found on $PATH")
+	}
+
+	r, err := NewServerWithOptions(Options{Backend: BackendProcess, Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("could not create password-protected server: %v", err)
+	}
+	defer r.Stop()
+
+	if err := r.WaitReady(50 * time.Millisecond); err != nil {
+		t.Fatalf("could not connect to server in time: %v", err)
+	}
+
+	if _, err := r.Info(); err != nil {
+		t.Fatalf("Info should AUTH automatically: %v", err)
+	}
+
+	conn, err := redigo.Dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to disposable server: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err == nil {
+		t.Fatal("expected PING without AUTH to fail on a password-protected server")
+	}
+
+	if _, err := conn.Do("AUTH", "hunter2"); err != nil {
+		t.Fatalf("could not AUTH with the configured password: %v", err)
+	}
+	if _, err := conn.Do("PING"); err != nil {
+		t.Fatalf("could not talk to redis after AUTH: %v", err)
+	}
+}
+
 func ExampleServer() {
 
 	// create a new server on a random port
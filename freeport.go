@@ -0,0 +1,18 @@
+package disposable_redis
+
+import "net"
+
+// freeport asks the kernel for a free open port that is ready to use, by
+// briefly listening on "127.0.0.1:0" and recording the port it was assigned.
+// This is still racy (another process could grab the port between us closing
+// the listener and redis-server binding it) but far less so than picking a
+// random port and hoping nothing else is using it.
+func freeport() (uint16, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	return uint16(l.Addr().(*net.TCPAddr).Port), nil
+}
@@ -0,0 +1,92 @@
+package disposable_redis
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// miniServer is a Server backed by an embedded, pure-Go miniredis instance
+// rather than a real redis-server process. It's used as the BackendMini
+// implementation, and is what BackendAuto falls back to when RedisCommand
+// can't be found.
+type miniServer struct {
+	mr       *miniredis.Miniredis
+	password string
+	logCh    chan string
+}
+
+// newMiniServer starts a miniredis instance listening on a real, kernel-assigned
+// TCP port and wraps it as a Server. Of Options, only Password is honored.
+// Port and UnixSocket are ignored (the port is always kernel-assigned); the
+// other options are rejected by NewServerWithOptions before this is reached.
+func newMiniServer(opts Options) (Server, error) {
+	mr := miniredis.NewMiniRedis()
+	if opts.Password != "" {
+		mr.RequireAuth(opts.Password)
+	}
+	if err := mr.Start(); err != nil {
+		return nil, err
+	}
+
+	logCh := make(chan string)
+	close(logCh) // miniredis has no process, so there's never anything to stream
+
+	return &miniServer{mr: mr, password: opts.Password, logCh: logCh}, nil
+}
+
+// Port returns the port this server is listening on
+func (m *miniServer) Port() uint16 {
+	port, _ := strconv.Atoi(m.mr.Port())
+	return uint16(port)
+}
+
+// Addr returns the address of the server as a host:port string
+func (m *miniServer) Addr() string {
+	return m.mr.Addr()
+}
+
+// WaitReady is a no-op for miniServer, since it's ready as soon as it's created.
+func (m *miniServer) WaitReady(timeout time.Duration) error {
+	return nil
+}
+
+// Stop shuts the miniredis instance down
+func (m *miniServer) Stop() error {
+	m.mr.Close()
+	return nil
+}
+
+// Info returns the value of the server's INFO command parsed into a map of strings
+func (m *miniServer) Info() (map[string]string, error) {
+	conn, e := dialAuth("tcp", m.Addr(), m.password)
+	if e != nil {
+		return nil, e
+	}
+	defer conn.Close()
+
+	info, err := redigo.String(conn.Do("INFO"))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseInfo(info), nil
+}
+
+// NewSlaveOf is not supported by the miniredis backend, which doesn't implement replication.
+func (m *miniServer) NewSlaveOf() (Server, error) {
+	return nil, fmt.Errorf("disposable_redis: replication is not supported by the miniredis backend")
+}
+
+// Logs always returns nil: miniredis has no process, so there's no stdout/stderr to capture.
+func (m *miniServer) Logs() []string {
+	return nil
+}
+
+// LogStream returns an already-closed channel, since miniredis never produces any log lines.
+func (m *miniServer) LogStream() <-chan string {
+	return m.logCh
+}
@@ -0,0 +1,267 @@
+package disposable_redis
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// The redis-sentinel executable. This allows you to set it if you're using a custom one.
+// Can be an absolute path, or an executable in your $PATH
+var SentinelCommand = "redis-sentinel"
+
+const (
+	// DefaultQuorum is the quorum used by NewSentinelCluster, when none is specified.
+	DefaultQuorum = 2
+
+	// how many sentinel processes we spawn to monitor a cluster of masters
+	sentinelCount = 3
+
+	sentinelDownAfterMillis   = 5000
+	sentinelFailoverTimeoutMs = 10000
+)
+
+// masterGroup is a single master and its replicas, monitored by a SentinelCluster.
+type masterGroup struct {
+	name     string
+	master   Server
+	replicas []Server
+}
+
+// sentinelProcess is a single disposable redis-sentinel instance.
+type sentinelProcess struct {
+	cmd      *exec.Cmd
+	port     uint16
+	confPath string
+}
+
+// SentinelCluster is a group of disposable redis-servers, organized into one or
+// more master/replica groups, monitored by a set of disposable redis-sentinel
+// processes wired together to watch the same masters.
+type SentinelCluster struct {
+	groups    []*masterGroup
+	sentinels []*sentinelProcess
+	quorum    int
+}
+
+// NewSentinel spawns a single master (with no replicas) monitored by a
+// sentinel group under the given master name, using quorum as the sentinel
+// quorum size. It's a convenience wrapper around NewSentinelCluster for the
+// common single-master case.
+func NewSentinel(masterName string, quorum int) (*SentinelCluster, error) {
+	return newSentinelCluster([]string{masterName}, 0, quorum)
+}
+
+// NewSentinelCluster spawns `masters` disposable redis-servers, each with
+// replicasPerMaster replicas, plus a group of disposable redis-sentinel
+// processes that monitor all of them. The masters are named "master-0",
+// "master-1", etc.
+func NewSentinelCluster(masters int, replicasPerMaster int) (*SentinelCluster, error) {
+	names := make([]string, masters)
+	for i := range names {
+		names[i] = fmt.Sprintf("master-%d", i)
+	}
+	return newSentinelCluster(names, replicasPerMaster, DefaultQuorum)
+}
+
+func newSentinelCluster(names []string, replicasPerMaster int, quorum int) (*SentinelCluster, error) {
+	sc := &SentinelCluster{quorum: quorum}
+
+	ok := false
+	defer func() {
+		if !ok {
+			sc.Stop()
+		}
+	}()
+
+	for _, name := range names {
+		master, err := NewServerWithOptions(Options{Backend: BackendProcess})
+		if err != nil {
+			return nil, err
+		}
+		if err := master.WaitReady(LaunchWaitTimeout); err != nil {
+			return nil, err
+		}
+
+		group := &masterGroup{name: name, master: master}
+		for i := 0; i < replicasPerMaster; i++ {
+			replica, err := master.NewSlaveOf()
+			if err != nil {
+				return nil, err
+			}
+			group.replicas = append(group.replicas, replica)
+		}
+		sc.groups = append(sc.groups, group)
+	}
+
+	for i := 0; i < sentinelCount; i++ {
+		sp, err := startSentinel(sc.groups, quorum)
+		if err != nil {
+			return nil, err
+		}
+		sc.sentinels = append(sc.sentinels, sp)
+	}
+
+	ok = true
+	return sc, nil
+}
+
+// startSentinel writes a temp sentinel config file monitoring every group in
+// groups, and launches a redis-sentinel process against it.
+func startSentinel(groups []*masterGroup, quorum int) (*sentinelProcess, error) {
+
+	port, err := freeport()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "disposable-sentinel-")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "port %d\n", port)
+	for _, g := range groups {
+		fmt.Fprintf(f, "sentinel monitor %s 127.0.0.1 %d %d\n", g.name, g.master.Port(), quorum)
+		fmt.Fprintf(f, "sentinel down-after-milliseconds %s %d\n", g.name, sentinelDownAfterMillis)
+		fmt.Fprintf(f, "sentinel failover-timeout %s %d\n", g.name, sentinelFailoverTimeoutMs)
+	}
+
+	cmd := exec.Command(SentinelCommand, f.Name())
+	log.Println("start args: ", cmd.Args)
+
+	sp := &sentinelProcess{cmd: cmd, port: port, confPath: f.Name()}
+
+	ret := cmd.Start()
+
+	ch := make(chan error)
+	go func() {
+		err := cmd.Wait()
+		select {
+		case ch <- err:
+		default:
+		}
+	}()
+
+	select {
+	case e := <-ch:
+		log.Println("Error waiting for sentinel process:", e)
+		os.Remove(f.Name())
+		return nil, e
+	case <-time.After(LaunchWaitTimeout):
+	}
+
+	if ret != nil {
+		os.Remove(f.Name())
+		return nil, ret
+	}
+
+	return sp, nil
+}
+
+// Addr returns the address of this sentinel as a host:port string
+func (sp *sentinelProcess) Addr() string {
+	return fmt.Sprintf("localhost:%d", sp.port)
+}
+
+func (sp *sentinelProcess) stop() error {
+	if sp.cmd.Process != nil {
+		sp.cmd.Process.Kill()
+		sp.cmd.Wait()
+	}
+	os.Remove(sp.confPath)
+	return nil
+}
+
+// MasterAddr asks any of the running sentinels for the current address of
+// the named master, following Sentinel's "get-master-addr-by-name" command.
+func (sc *SentinelCluster) MasterAddr(name string) (string, error) {
+	var lastErr error
+	for _, sp := range sc.sentinels {
+		conn, err := redigo.Dial("tcp", sp.Addr())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply, err := redigo.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", name))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(reply) != 2 {
+			lastErr = fmt.Errorf("disposable_redis: unexpected sentinel reply %v", reply)
+			continue
+		}
+		return fmt.Sprintf("%s:%s", reply[0], reply[1]), nil
+	}
+	return "", lastErr
+}
+
+// SentinelAddrs returns the addresses of the disposable redis-sentinel processes.
+func (sc *SentinelCluster) SentinelAddrs() []string {
+	addrs := make([]string, len(sc.sentinels))
+	for i, sp := range sc.sentinels {
+		addrs[i] = sp.Addr()
+	}
+	return addrs
+}
+
+// Failover asks the sentinels to force a failover of the named master, and
+// waits until they report a new master address.
+func (sc *SentinelCluster) Failover(name string) error {
+	before, _ := sc.MasterAddr(name)
+
+	var lastErr error
+	sent := false
+	for _, sp := range sc.sentinels {
+		conn, err := redigo.Dial("tcp", sp.Addr())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		_, err = conn.Do("SENTINEL", "failover", name)
+		conn.Close()
+		if err == nil {
+			sent = true
+			break
+		}
+		lastErr = err
+	}
+	if !sent {
+		return lastErr
+	}
+
+	deadline := time.Now().Add(time.Duration(sentinelFailoverTimeoutMs) * time.Millisecond)
+	for time.Now().Before(deadline) {
+		after, err := sc.MasterAddr(name)
+		if err == nil && after != before {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return fmt.Errorf("disposable_redis: timed out waiting for sentinel failover of %q to complete", name)
+}
+
+// Stop shuts down every sentinel and redis-server process in the cluster.
+func (sc *SentinelCluster) Stop() error {
+	for _, sp := range sc.sentinels {
+		sp.stop()
+	}
+	for _, g := range sc.groups {
+		for _, r := range g.replicas {
+			r.Stop()
+		}
+		if g.master != nil {
+			g.master.Stop()
+		}
+	}
+	return nil
+}
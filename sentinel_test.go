@@ -0,0 +1,91 @@
+package disposable_redis
+
+import (
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// TestSentinelCluster spins up a single master (with no replicas) monitored by
+// a sentinel group, and makes sure the sentinels report the master's address.
+func TestSentinelCluster(t *testing.T) {
+	if !redisServerAvailable() {
+		t.Skip("redis-server not found on $PATH")
+	}
+	if !sentinelAvailable() {
+		t.Skip("redis-sentinel not found on $PATH")
+	}
+
+	sc, err := NewSentinel("master-0", 2)
+	if err != nil {
+		t.Fatalf("could not create sentinel cluster: %v", err)
+	}
+	defer sc.Stop()
+
+	if len(sc.SentinelAddrs()) != sentinelCount {
+		t.Fatalf("expected %d sentinels, got %d", sentinelCount, len(sc.SentinelAddrs()))
+	}
+
+	addr, err := sc.MasterAddr("master-0")
+	if err != nil {
+		t.Fatalf("could not get master address: %v", err)
+	}
+	if addr == "" {
+		t.Fatal("expected a non-empty master address")
+	}
+}
+
+// TestSentinelClusterFailover writes a key to the master, forces a sentinel
+// failover, and makes sure the sentinels report a new master that serves the
+// key it inherited from the old one.
+func TestSentinelClusterFailover(t *testing.T) {
+	if !redisServerAvailable() {
+		t.Skip("redis-server not found on $PATH")
+	}
+	if !sentinelAvailable() {
+		t.Skip("redis-sentinel not found on $PATH")
+	}
+
+	sc, err := NewSentinelCluster(1, 1)
+	if err != nil {
+		t.Fatalf("could not create sentinel cluster: %v", err)
+	}
+	defer sc.Stop()
+
+	before, err := sc.MasterAddr("master-0")
+	if err != nil {
+		t.Fatalf("could not get master address: %v", err)
+	}
+
+	conn, err := redigo.Dial("tcp", before)
+	if err != nil {
+		t.Fatalf("could not connect to master: %v", err)
+	}
+	if _, err := conn.Do("SET", "foo", "bar"); err != nil {
+		t.Fatalf("could not SET on master: %v", err)
+	}
+	conn.Close()
+
+	if err := sc.Failover("master-0"); err != nil {
+		t.Fatalf("failover failed: %v", err)
+	}
+
+	after, err := sc.MasterAddr("master-0")
+	if err != nil {
+		t.Fatalf("could not get master address after failover: %v", err)
+	}
+	if after == before {
+		t.Fatalf("expected a new master address after failover, still %q", after)
+	}
+
+	newConn, err := redigo.Dial("tcp", after)
+	if err != nil {
+		t.Fatalf("could not connect to new master: %v", err)
+	}
+	defer newConn.Close()
+
+	val, err := redigo.String(newConn.Do("GET", "foo"))
+	if err != nil || val != "bar" {
+		t.Fatalf("new master doesn't have the pre-failover data: %q, %v", val, err)
+	}
+}